@@ -0,0 +1,160 @@
+// Package config loads the buildpack's own configuration file
+// (buildpack.yml or buildpack.json) into a typed Config, rejecting unknown
+// keys and reporting every problem found in one pass.
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	yaml "gopkg.in/yaml.v3"
+)
+
+// TLSConfig sets ssl_protocols (MinVersion, written as the only protocol)
+// and ssl_ciphers in the server block of a generated default nginx.conf.
+// The generated listen directive does not enable ssl.
+type TLSConfig struct {
+	MinVersion string `yaml:"min_version" json:"min_version"`
+	Ciphers    string `yaml:"ciphers" json:"ciphers"`
+}
+
+// NginxConfig is the `nginx:` section of buildpack.yml/buildpack.json.
+type NginxConfig struct {
+	Version           string    `yaml:"version" json:"version"`
+	Modules           []string  `yaml:"modules" json:"modules"`
+	WorkerProcesses   string    `yaml:"worker_processes" json:"worker_processes"`
+	WorkerConnections int       `yaml:"worker_connections" json:"worker_connections"`
+	ClientMaxBodySize string    `yaml:"client_max_body_size" json:"client_max_body_size"`
+	TLS               TLSConfig `yaml:"tls" json:"tls"`
+}
+
+// Config is the root of buildpack.yml/buildpack.json.
+type Config struct {
+	Nginx NginxConfig `yaml:"nginx" json:"nginx"`
+}
+
+// knownKeys maps a dotted key path to the keys allowed directly under it.
+// The root is keyed by the empty string.
+var knownKeys = map[string][]string{
+	"":          {"nginx"},
+	"nginx":     {"version", "modules", "worker_processes", "worker_connections", "client_max_body_size", "tls"},
+	"nginx.tls": {"min_version", "ciphers"},
+}
+
+// ValidationError collects every unrecognized key found while loading a
+// config file, instead of surfacing only the first one.
+type ValidationError struct {
+	Path     string
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("%s is invalid:\n  - %s", e.Path, strings.Join(e.Problems, "\n  - "))
+}
+
+// Loader decodes buildpack.yml/buildpack.json, choosing YAML or JSON based
+// on the file extension.
+type Loader struct{}
+
+// NewLoader returns a Loader ready to use.
+func NewLoader() *Loader {
+	return &Loader{}
+}
+
+// Load decodes body (read from the file at path) into a Config. path is
+// only used to pick a decoder by extension and to annotate errors.
+func (l *Loader) Load(path string, body []byte) (Config, error) {
+	raw, err := decodeRaw(path, body)
+	if err != nil {
+		return Config{}, err
+	}
+
+	if problems := validateKeys("", raw); len(problems) > 0 {
+		return Config{}, &ValidationError{Path: path, Problems: problems}
+	}
+
+	normalized, err := json.Marshal(raw)
+	if err != nil {
+		return Config{}, fmt.Errorf("could not decode %s: %s", path, err)
+	}
+
+	var cfg Config
+	if err := json.Unmarshal(normalized, &cfg); err != nil {
+		return Config{}, fmt.Errorf("could not decode %s: %s", path, err)
+	}
+
+	return cfg, nil
+}
+
+func decodeRaw(path string, body []byte) (map[string]interface{}, error) {
+	var raw map[string]interface{}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yml", ".yaml":
+		if err := yaml.Unmarshal(body, &raw); err != nil {
+			return nil, fmt.Errorf("could not parse %s: %s", path, err)
+		}
+	case ".json":
+		if err := json.Unmarshal(body, &raw); err != nil {
+			return nil, fmt.Errorf("could not parse %s: %s", path, err)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported buildpack config extension: %s", path)
+	}
+
+	if raw == nil {
+		raw = map[string]interface{}{}
+	}
+	return raw, nil
+}
+
+func validateKeys(prefix string, raw map[string]interface{}) []string {
+	allowed, known := knownKeys[prefix]
+
+	var problems []string
+	for key, value := range raw {
+		full := joinKey(prefix, key)
+		if !known || !contains(allowed, key) {
+			problems = append(problems, fmt.Sprintf("unknown key %q", full))
+			continue
+		}
+		if nested, ok := value.(map[string]interface{}); ok {
+			problems = append(problems, validateKeys(full, nested)...)
+		}
+	}
+
+	sort.Strings(problems)
+	return problems
+}
+
+func joinKey(prefix, key string) string {
+	if prefix == "" {
+		return key
+	}
+	return prefix + "." + key
+}
+
+func contains(haystack []string, needle string) bool {
+	for _, v := range haystack {
+		if v == needle {
+			return true
+		}
+	}
+	return false
+}
+
+// WantsDefaultNginxConf reports whether the app configured enough of the
+// nginx section that the buildpack should generate a default nginx.conf on
+// the app's behalf rather than require a handwritten one.
+func (c Config) WantsDefaultNginxConf() bool {
+	n := c.Nginx
+	return len(n.Modules) > 0 ||
+		n.WorkerProcesses != "" ||
+		n.WorkerConnections != 0 ||
+		n.ClientMaxBodySize != "" ||
+		n.TLS.MinVersion != "" ||
+		n.TLS.Ciphers != ""
+}
@@ -0,0 +1,100 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLoadYAML(t *testing.T) {
+	body := []byte(`
+nginx:
+  version: "1.25.x"
+  modules: ["brotli"]
+  worker_processes: "4"
+`)
+
+	cfg, err := NewLoader().Load("buildpack.yml", body)
+	if err != nil {
+		t.Fatalf("Load: %s", err)
+	}
+
+	if cfg.Nginx.Version != "1.25.x" {
+		t.Errorf("Version = %q, want %q", cfg.Nginx.Version, "1.25.x")
+	}
+	if len(cfg.Nginx.Modules) != 1 || cfg.Nginx.Modules[0] != "brotli" {
+		t.Errorf("Modules = %v, want [brotli]", cfg.Nginx.Modules)
+	}
+}
+
+func TestLoadJSON(t *testing.T) {
+	body := []byte(`{"nginx": {"version": "1.25.x", "client_max_body_size": "10m"}}`)
+
+	cfg, err := NewLoader().Load("buildpack.json", body)
+	if err != nil {
+		t.Fatalf("Load: %s", err)
+	}
+
+	if cfg.Nginx.ClientMaxBodySize != "10m" {
+		t.Errorf("ClientMaxBodySize = %q, want %q", cfg.Nginx.ClientMaxBodySize, "10m")
+	}
+}
+
+func TestLoadUnsupportedExtension(t *testing.T) {
+	if _, err := NewLoader().Load("buildpack.toml", []byte("nginx = {}")); err == nil {
+		t.Fatal("expected an error for an unsupported extension, got nil")
+	}
+}
+
+// TestLoadReportsEveryUnknownKey exercises the strict decoding this package
+// exists for: every unrecognized key should be reported in one pass, not
+// just the first one found.
+func TestLoadReportsEveryUnknownKey(t *testing.T) {
+	body := []byte(`
+nginx:
+  version: "1.25.x"
+  bogus_top_level: true
+  tls:
+    min_version: "TLSv1.2"
+    bogus_tls_key: true
+`)
+
+	_, err := NewLoader().Load("buildpack.yml", body)
+	if err == nil {
+		t.Fatal("expected a ValidationError, got nil")
+	}
+
+	verr, ok := err.(*ValidationError)
+	if !ok {
+		t.Fatalf("error is %T, want *ValidationError", err)
+	}
+	if len(verr.Problems) != 2 {
+		t.Fatalf("Problems = %v, want 2 problems", verr.Problems)
+	}
+	msg := verr.Error()
+	if !strings.Contains(msg, "nginx.bogus_top_level") {
+		t.Errorf("error message %q does not mention nginx.bogus_top_level", msg)
+	}
+	if !strings.Contains(msg, "nginx.tls.bogus_tls_key") {
+		t.Errorf("error message %q does not mention nginx.tls.bogus_tls_key", msg)
+	}
+}
+
+func TestWantsDefaultNginxConf(t *testing.T) {
+	cases := []struct {
+		name string
+		cfg  Config
+		want bool
+	}{
+		{"zero value", Config{}, false},
+		{"modules set", Config{Nginx: NginxConfig{Modules: []string{"brotli"}}}, true},
+		{"tls set", Config{Nginx: NginxConfig{TLS: TLSConfig{MinVersion: "TLSv1.2"}}}, true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := c.cfg.WantsDefaultNginxConf(); got != c.want {
+				t.Errorf("WantsDefaultNginxConf() = %v, want %v", got, c.want)
+			}
+		})
+	}
+}
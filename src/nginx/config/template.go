@@ -0,0 +1,93 @@
+package config
+
+import (
+	"strings"
+	"text/template"
+)
+
+// defaultNginxConfTemplate renders a default nginx.conf from the typed
+// `nginx:` config when the app ships none of its own. It uses [[ ]] action
+// delimiters instead of the usual {{ }} so that the {{port}}/{{module ...}}
+// tokens it emits pass through untouched for varify to expand at stage/start
+// time. access_log/error_log point at the launcher's named pipes (falling
+// back to their well-known paths so staging's varify preflight, which runs
+// without the launcher's environment, still renders valid syntax) so the
+// launcher's log streaming actually has something writing to it.
+const defaultNginxConfTemplate = `
+[[- range .Modules]]
+{{module "[[.]]"}}
+[[- end]]
+worker_processes [[.WorkerProcesses]];
+
+events {
+  worker_connections [[.WorkerConnections]];
+}
+
+http {
+  include       mime.types;
+  default_type  application/octet-stream;
+  sendfile      on;
+
+  server {
+    listen {{port}};
+    client_max_body_size [[.ClientMaxBodySize]];
+    access_log {{env "NGINX_ACCESS_LOG" "logs/access.fifo"}};
+    error_log {{env "NGINX_ERROR_LOG" "logs/error.fifo"}};
+[[- if .TLSEnabled]]
+    ssl_protocols [[.TLSMinVersion]];
+    ssl_ciphers [[.TLSCiphers]];
+[[- end]]
+
+    location / {
+      root  public;
+      index index.html index.htm;
+    }
+  }
+}
+`
+
+type nginxConfTemplateData struct {
+	Modules           []string
+	WorkerProcesses   string
+	WorkerConnections int
+	ClientMaxBodySize string
+	TLSEnabled        bool
+	TLSMinVersion     string
+	TLSCiphers        string
+}
+
+// RenderDefaultNginxConf fills in defaults for any unset typed field and
+// renders defaultNginxConfTemplate against them.
+func (c Config) RenderDefaultNginxConf() (string, error) {
+	n := c.Nginx
+
+	data := nginxConfTemplateData{
+		Modules:           n.Modules,
+		WorkerProcesses:   n.WorkerProcesses,
+		WorkerConnections: n.WorkerConnections,
+		ClientMaxBodySize: n.ClientMaxBodySize,
+		TLSEnabled:        n.TLS.MinVersion != "" || n.TLS.Ciphers != "",
+		TLSMinVersion:     n.TLS.MinVersion,
+		TLSCiphers:        n.TLS.Ciphers,
+	}
+	if data.WorkerProcesses == "" {
+		data.WorkerProcesses = "auto"
+	}
+	if data.WorkerConnections == 0 {
+		data.WorkerConnections = 1024
+	}
+	if data.ClientMaxBodySize == "" {
+		data.ClientMaxBodySize = "1m"
+	}
+
+	t, err := template.New("nginx.conf").Delims("[[", "]]").Parse(defaultNginxConfTemplate)
+	if err != nil {
+		return "", err
+	}
+
+	var out strings.Builder
+	if err := t.Execute(&out, data); err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	accessLogFifo      = "logs/access.fifo"
+	errorLogFifo       = "logs/error.fifo"
+	defaultDrainPeriod = 10 * time.Second
+)
+
+func main() {
+	if err := run(); err != nil {
+		log.Fatalf("launcher: %s", err)
+	}
+}
+
+func run() error {
+	workDir, err := os.Getwd()
+	if err != nil {
+		return fmt.Errorf("could not determine working directory: %s", err)
+	}
+
+	varifyBin, err := exec.LookPath("varify")
+	if err != nil {
+		return fmt.Errorf("could not find varify on PATH: %s", err)
+	}
+
+	nginxBin, err := exec.LookPath("nginx")
+	if err != nil {
+		return fmt.Errorf("could not find nginx on PATH: %s", err)
+	}
+
+	confPath := filepath.Join(workDir, "nginx.conf")
+
+	access, err := startLogPipe(filepath.Join(workDir, accessLogFifo), os.Stdout)
+	if err != nil {
+		return fmt.Errorf("could not set up access log streaming: %s", err)
+	}
+	defer access.Close()
+
+	errLog, err := startLogPipe(filepath.Join(workDir, errorLogFifo), os.Stderr)
+	if err != nil {
+		return fmt.Errorf("could not set up error log streaming: %s", err)
+	}
+	defer errLog.Close()
+
+	os.Setenv("NGINX_ACCESS_LOG", access.path)
+	os.Setenv("NGINX_ERROR_LOG", errLog.path)
+
+	if err := renderConf(varifyBin, confPath); err != nil {
+		return fmt.Errorf("could not render nginx.conf: %s", err)
+	}
+
+	cmd := exec.Command(nginxBin, "-g", "daemon off;", "-c", confPath, "-p", workDir)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("could not start nginx: %s", err)
+	}
+
+	go forwardSignals(cmd, varifyBin, confPath, drainPeriod())
+
+	if err := cmd.Wait(); err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			os.Exit(exitErr.ExitCode())
+		}
+		return fmt.Errorf("nginx exited with error: %s", err)
+	}
+	return nil
+}
+
+// confTemplate holds nginx.conf as it was before the first render, since
+// varify overwrites the file with its rendered output.
+var confTemplate []byte
+
+// renderConf re-expands {{port}} and {{env ...}} in nginx.conf from the
+// launcher's environment. It is called before the first start and again on
+// every SIGHUP; each call restores the original template first, so a reload
+// re-renders every token rather than the already-rendered file.
+func renderConf(varifyBin, confPath string) error {
+	if confTemplate == nil {
+		body, err := ioutil.ReadFile(confPath)
+		if err != nil {
+			return err
+		}
+		confTemplate = body
+	} else if err := ioutil.WriteFile(confPath, confTemplate, 0644); err != nil {
+		return err
+	}
+
+	cmd := exec.Command(varifyBin, confPath)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+func drainPeriod() time.Duration {
+	v := os.Getenv("NGINX_LAUNCHER_DRAIN_TIMEOUT")
+	if v == "" {
+		return defaultDrainPeriod
+	}
+	seconds, err := strconv.Atoi(v)
+	if err != nil || seconds < 0 {
+		return defaultDrainPeriod
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// forwardSignals re-renders nginx.conf and asks nginx to reload on SIGHUP,
+// and turns SIGTERM/SIGINT into a graceful shutdown (SIGQUIT) followed by an
+// unconditional SIGTERM if nginx hasn't drained its connections in time.
+func forwardSignals(cmd *exec.Cmd, varifyBin, confPath string, drainTimeout time.Duration) {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGHUP, syscall.SIGTERM, syscall.SIGINT)
+
+	for sig := range sigCh {
+		switch sig {
+		case syscall.SIGHUP:
+			if err := renderConf(varifyBin, confPath); err != nil {
+				log.Printf("launcher: could not re-render nginx.conf, skipping reload: %s", err)
+				continue
+			}
+			if err := cmd.Process.Signal(syscall.SIGHUP); err != nil {
+				log.Printf("launcher: could not signal nginx to reload: %s", err)
+			}
+		case syscall.SIGTERM, syscall.SIGINT:
+			cmd.Process.Signal(syscall.SIGQUIT)
+			timer := time.AfterFunc(drainTimeout, func() {
+				cmd.Process.Signal(syscall.SIGTERM)
+			})
+			defer timer.Stop()
+		}
+	}
+}
+
+// logPipe streams a named pipe's contents to dest for as long as the
+// launcher runs, so nginx can log to a normal file path instead of relying
+// on /dev/stdout, which isn't writable on every stack.
+type logPipe struct {
+	path string
+
+	mu   sync.Mutex
+	file *os.File
+}
+
+func startLogPipe(path string, dest io.Writer) (*logPipe, error) {
+	os.Remove(path)
+	if err := syscall.Mkfifo(path, 0666); err != nil {
+		return nil, fmt.Errorf("could not create named pipe %s: %s", path, err)
+	}
+
+	lp := &logPipe{path: path}
+	go func() {
+		f, err := os.OpenFile(lp.path, os.O_RDONLY, os.ModeNamedPipe)
+		if err != nil {
+			log.Printf("launcher: could not open named pipe %s: %s", lp.path, err)
+			return
+		}
+		lp.mu.Lock()
+		lp.file = f
+		lp.mu.Unlock()
+		io.Copy(dest, f)
+	}()
+	return lp, nil
+}
+
+func (lp *logPipe) Close() error {
+	lp.mu.Lock()
+	f := lp.file
+	lp.mu.Unlock()
+	if f == nil {
+		return nil
+	}
+	return f.Close()
+}
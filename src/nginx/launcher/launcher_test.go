@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestDrainPeriodDefault(t *testing.T) {
+	os.Unsetenv("NGINX_LAUNCHER_DRAIN_TIMEOUT")
+
+	if got := drainPeriod(); got != defaultDrainPeriod {
+		t.Errorf("drainPeriod() = %s, want %s", got, defaultDrainPeriod)
+	}
+}
+
+func TestDrainPeriodFromEnv(t *testing.T) {
+	os.Setenv("NGINX_LAUNCHER_DRAIN_TIMEOUT", "5")
+	defer os.Unsetenv("NGINX_LAUNCHER_DRAIN_TIMEOUT")
+
+	if got, want := drainPeriod(), 5*time.Second; got != want {
+		t.Errorf("drainPeriod() = %s, want %s", got, want)
+	}
+}
+
+func TestDrainPeriodIgnoresGarbage(t *testing.T) {
+	os.Setenv("NGINX_LAUNCHER_DRAIN_TIMEOUT", "not-a-number")
+	defer os.Unsetenv("NGINX_LAUNCHER_DRAIN_TIMEOUT")
+
+	if got := drainPeriod(); got != defaultDrainPeriod {
+		t.Errorf("drainPeriod() = %s, want %s", got, defaultDrainPeriod)
+	}
+}
+
+// syncBuffer lets the background logPipe goroutine and the test's assertions
+// read/write concurrently without racing.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestStartLogPipeStreamsWriterToDestination(t *testing.T) {
+	dir, err := ioutil.TempDir("", "launcher-fifo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	dest := &syncBuffer{}
+	pipe, err := startLogPipe(filepath.Join(dir, "test.fifo"), dest)
+	if err != nil {
+		t.Fatalf("startLogPipe: %s", err)
+	}
+	defer pipe.Close()
+
+	w, err := os.OpenFile(pipe.path, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatalf("could not open fifo for writing: %s", err)
+	}
+	if _, err := w.Write([]byte("hello from nginx\n")); err != nil {
+		t.Fatalf("could not write to fifo: %s", err)
+	}
+	w.Close()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if dest.String() == "hello from nginx\n" {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("destination never received piped output, got %q", dest.String())
+}
+
+// TestLauncherBootsAgainstFakeApp exercises run() end to end against a fake
+// "nginx" and "varify" on PATH: it confirms the launcher renders the config,
+// starts "nginx", and forwards SIGTERM through to a clean exit.
+func TestLauncherBootsAgainstFakeApp(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test in short mode")
+	}
+
+	appDir, err := ioutil.TempDir("", "launcher-app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(appDir)
+
+	if err := os.Mkdir(filepath.Join(appDir, "logs"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(appDir, "nginx.conf"), []byte("daemon off;\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	binDir := writeFakeBinaries(t)
+
+	oldPath := os.Getenv("PATH")
+	os.Setenv("PATH", binDir+string(os.PathListSeparator)+oldPath)
+	defer os.Setenv("PATH", oldPath)
+
+	oldWd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(appDir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(oldWd)
+
+	done := make(chan error, 1)
+	go func() { done <- run() }()
+
+	time.Sleep(300 * time.Millisecond)
+	if err := syscall.Kill(os.Getpid(), syscall.SIGTERM); err != nil {
+		t.Fatalf("could not signal test process: %s", err)
+	}
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("run() returned error: %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("launcher did not shut down after SIGTERM")
+	}
+}
+
+// writeFakeBinaries stages fake "varify" and "nginx" executables that behave
+// just enough like the real thing for run() to exercise its full start/signal
+// path without needing either binary to be installed.
+func writeFakeBinaries(t *testing.T) string {
+	t.Helper()
+
+	binDir, err := ioutil.TempDir("", "launcher-fakebin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(binDir, "varify"), []byte("#!/bin/sh\nexit 0\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	fakeNginx := "#!/bin/sh\ntrap 'exit 0' TERM QUIT\nwhile true; do sleep 0.1; done\n"
+	if err := ioutil.WriteFile(filepath.Join(binDir, "nginx"), []byte(fakeNginx), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	return binDir
+}
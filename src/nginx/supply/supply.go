@@ -13,7 +13,12 @@ import (
 	"sort"
 	"strings"
 
+	"github.com/BurntSushi/toml"
 	"github.com/cloudfoundry/libbuildpack"
+	nginxconf "github.com/tufanbarisyildirim/gonginx/config"
+	"github.com/tufanbarisyildirim/gonginx/parser"
+
+	"nginx/config"
 )
 
 type Command interface {
@@ -42,12 +47,24 @@ type Stager interface {
 	WriteProfileD(string, string) error
 }
 
-type Config struct {
-	Nginx NginxConfig `yaml:"nginx"`
+// CacheStager is an optional capability a Stager can implement to get a
+// persistent directory that survives across staging runs. Supplier uses it
+// to cache the downloaded nginx dependency instead of re-fetching it every
+// time the resolved version hasn't changed.
+type CacheStager interface {
+	CacheDir() string
+}
+
+type nginxCacheMetadata struct {
+	Version string `toml:"version"`
+	Stack   string `toml:"stack"`
+	Stable  bool   `toml:"stable"`
 }
 
-type NginxConfig struct {
-	Version string `yaml:"version"`
+// ConfigLoader decodes the buildpack's own config file. It is satisfied by
+// *config.Loader; tests can substitute a fake.
+type ConfigLoader interface {
+	Load(path string, body []byte) (config.Config, error)
 }
 
 type Supplier struct {
@@ -55,18 +72,20 @@ type Supplier struct {
 	Manifest     Manifest
 	Installer    Installer
 	Log          *libbuildpack.Logger
-	Config       Config
+	Config       config.Config
+	ConfigLoader ConfigLoader
 	Command      Command
 	VersionLines map[string]string
 }
 
 func New(stager Stager, manifest Manifest, installer Installer, logger *libbuildpack.Logger, command Command) *Supplier {
 	return &Supplier{
-		Stager:    stager,
-		Manifest:  manifest,
-		Installer: installer,
-		Log:       logger,
-		Command:   command,
+		Stager:       stager,
+		Manifest:     manifest,
+		Installer:    installer,
+		Log:          logger,
+		Command:      command,
+		ConfigLoader: config.NewLoader(),
 	}
 }
 
@@ -77,6 +96,10 @@ func (s *Supplier) Run() error {
 		s.Log.Error("Failed to copy verify: %s", err.Error())
 		return err
 	}
+	if err := s.InstallLauncher(); err != nil {
+		s.Log.Error("Failed to copy launcher: %s", err.Error())
+		return err
+	}
 	if err := s.Setup(); err != nil {
 		s.Log.Error("Could not setup: %s", err.Error())
 		return err
@@ -87,6 +110,11 @@ func (s *Supplier) Run() error {
 		return err
 	}
 
+	if err := s.validateNginxModules(); err != nil {
+		s.Log.Error("Could not validate nginx modules: %s", err.Error())
+		return err
+	}
+
 	if err := s.validateNginxConf(); err != nil {
 		s.Log.Error("Could not validate nginx.conf: %s", err.Error())
 		return err
@@ -100,7 +128,14 @@ func (s *Supplier) Run() error {
 	return nil
 }
 
+// WriteProfileD stages a profile.d script that exports the env vars nginx
+// and launcher need at boot. It cannot set the app's start command -
+// profile.d scripts source into an already-chosen command, they don't choose
+// one - so this only stages launcher (see InstallLauncher) and recommends it
+// via the log; the app still has to set `launcher` as its own start command
+// to get supervision, reload, and log streaming.
 func (s *Supplier) WriteProfileD() error {
+	s.Log.Info("`launcher` has been staged to $DEPS_DIR/%s/bin - set it as your app's start command to get nginx supervision with reload and log streaming support.", s.Stager.DepsIdx())
 	return s.Stager.WriteProfileD("nginx", fmt.Sprintf("export NGINX_MODULES=%s\nmkdir -p logs", filepath.Join("$DEPS_DIR", s.Stager.DepsIdx(), "nginx", "nginx", "modules")))
 }
 
@@ -114,14 +149,26 @@ func (s *Supplier) InstallVarify() error {
 	return libbuildpack.CopyFile(filepath.Join(s.Manifest.RootDir(), "bin", "varify"), filepath.Join(s.Stager.DepDir(), "bin", "varify"))
 }
 
-func (s *Supplier) Setup() error {
-	configPath := filepath.Join(s.Stager.BuildDir(), "buildpack.yml")
-	if exists, err := libbuildpack.FileExists(configPath); err != nil {
+// InstallLauncher stages the launcher binary into $DEPS_DIR/<idx>/bin
+// alongside varify, so apps can point their start command at `launcher`
+// instead of invoking nginx directly.
+func (s *Supplier) InstallLauncher() error {
+	if exists, err := libbuildpack.FileExists(filepath.Join(s.Stager.DepDir(), "bin", "launcher")); err != nil {
 		return err
 	} else if exists {
-		if err := libbuildpack.NewYAML().Load(configPath, &s.Config); err != nil {
-			return err
-		}
+		return nil
+	}
+
+	return libbuildpack.CopyFile(filepath.Join(s.Manifest.RootDir(), "bin", "launcher"), filepath.Join(s.Stager.DepDir(), "bin", "launcher"))
+}
+
+func (s *Supplier) Setup() error {
+	if err := s.loadConfig(); err != nil {
+		return err
+	}
+
+	if err := s.generateDefaultNginxConf(); err != nil {
+		return err
 	}
 
 	var m struct {
@@ -140,13 +187,99 @@ func (s *Supplier) Setup() error {
 	return nil
 }
 
+// loadConfig reads buildpack.yml or buildpack.json from the app root,
+// whichever is present, into s.Config. It is not an error for neither to
+// exist; s.Config is simply left at its zero value.
+func (s *Supplier) loadConfig() error {
+	for _, name := range []string{"buildpack.yml", "buildpack.json"} {
+		path := filepath.Join(s.Stager.BuildDir(), name)
+		exists, err := libbuildpack.FileExists(path)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			continue
+		}
+
+		body, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		cfg, err := s.ConfigLoader.Load(path, body)
+		if err != nil {
+			return err
+		}
+		s.Config = cfg
+		return nil
+	}
+
+	return nil
+}
+
+// generateDefaultNginxConf writes a default nginx.conf from the typed
+// `nginx:` config when the app configured it but shipped no nginx.conf of
+// its own.
+func (s *Supplier) generateDefaultNginxConf() error {
+	if !s.Config.WantsDefaultNginxConf() {
+		return nil
+	}
+
+	confPath := filepath.Join(s.Stager.BuildDir(), "nginx.conf")
+	if exists, err := libbuildpack.FileExists(confPath); err != nil {
+		return err
+	} else if exists {
+		return nil
+	}
+
+	body, err := s.Config.RenderDefaultNginxConf()
+	if err != nil {
+		return fmt.Errorf("could not generate default nginx.conf: %s", err)
+	}
+
+	s.Log.Info("No nginx.conf found - generating one from buildpack config")
+	return ioutil.WriteFile(confPath, []byte(body), 0644)
+}
+
+// validateNginxModules checks every module requested in the `nginx:` config
+// was actually staged as a dynamic module, so a typo surfaces at staging
+// time instead of as a confusing `load_module` failure at boot.
+func (s *Supplier) validateNginxModules() error {
+	modulesDir := filepath.Join(s.Stager.DepDir(), "nginx", "nginx", "modules")
+
+	for _, name := range s.Config.Nginx.Modules {
+		modulePath := filepath.Join(modulesDir, name+".so")
+		exists, err := libbuildpack.FileExists(modulePath)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			s.Log.Error("nginx module %q was requested in buildpack config but is not available in %s", name, modulesDir)
+			return fmt.Errorf("unknown nginx module: %s", name)
+		}
+	}
+
+	return nil
+}
+
 func (s *Supplier) validateNginxConf() error {
 	if err := s.validateNginxConfExists(); err != nil {
 		return err
 	}
-	if err := s.validateNginxConfHasPort(); err != nil {
+
+	tree, err := s.parseNginxConf()
+	if err != nil {
+		s.Log.Error("nginx.conf contains syntax errors: %s", err.Error())
 		return err
 	}
+
+	if err := s.validateNginxConfHasPort(tree); err != nil {
+		return err
+	}
+	if err := s.validateNginxConfDirectives(tree); err != nil {
+		return err
+	}
+
 	return s.validateNginxConfSyntax()
 }
 
@@ -160,20 +293,151 @@ func (s *Supplier) validateNginxConfExists() error {
 	return nil
 }
 
-func (s *Supplier) validateNginxConfHasPort() error {
-	conf, err := ioutil.ReadFile(filepath.Join(s.Stager.BuildDir(), "nginx.conf"))
+// templateTokenPattern matches one of the buildpack's own unquoted template
+// tokens, e.g. `{{port}}` or `{{env "NGINX_ERROR_LOG"}}`.
+var templateTokenPattern = regexp.MustCompile(`\{\{[^{}]*\}\}`)
+
+// parsedNginxConf wraps the AST gonginx produces plus a reverse lookup from
+// the placeholder identifiers substituted in for template tokens back to
+// their original text, so later validation can tell a placeholder apart
+// from a directive the app actually wrote literally.
+type parsedNginxConf struct {
+	*nginxconf.Config
+	tokens map[string]string
+}
+
+// resolve returns the original template token a placeholder stands in for,
+// or value unchanged if it isn't a placeholder.
+func (p *parsedNginxConf) resolve(value string) string {
+	if original, ok := p.tokens[value]; ok {
+		return original
+	}
+	return value
+}
+
+// parseNginxConf parses nginx.conf into an AST once, so that every other
+// validation step can walk the same tree instead of re-reading and
+// re-parsing the file from scratch. The varify preflight in
+// validateNginxConfSyntax still re-reads the file independently: it runs
+// text/template over the raw source to expand {{port}}/{{env ...}}, which is
+// an entirely different pass from the nginx-grammar AST built here and
+// can't share it.
+//
+// `{` and `}` are structurally significant to nginx's grammar (they open and
+// close blocks), and this buildpack's template tokens are written unquoted,
+// e.g. `listen {{port}};`. Handed to gonginx as-is, `{{port}}` parses as two
+// nested anonymous blocks around a bare word, not as a `listen` parameter -
+// so every token is replaced with a syntactically-neutral placeholder
+// identifier before parsing, and mapped back afterwards.
+func (s *Supplier) parseNginxConf() (*parsedNginxConf, error) {
+	confPath := filepath.Join(s.Stager.BuildDir(), "nginx.conf")
+
+	body, err := ioutil.ReadFile(confPath)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	if portFound, err := regexp.Match("{{port}}", conf); err != nil {
-		return err
-	} else if !portFound {
-		s.Log.Error("nginx.conf file must be configured to respect the value of `{{port}}`")
-		return errors.New("no {{port}} in nginx.conf")
+
+	placeholderBody, tokens := placeholderizeTemplateTokens(body)
+
+	tree, err := parser.NewStringParser(string(placeholderBody)).Parse()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", confPath, err.Error())
+	}
+
+	return &parsedNginxConf{Config: tree, tokens: tokens}, nil
+}
+
+// placeholderizeTemplateTokens replaces every {{...}} template token in body
+// with a bare identifier that parses as a normal nginx word, returning the
+// rewritten body alongside a placeholder -> original token lookup.
+func placeholderizeTemplateTokens(body []byte) ([]byte, map[string]string) {
+	tokens := map[string]string{}
+	i := 0
+	replaced := templateTokenPattern.ReplaceAllFunc(body, func(match []byte) []byte {
+		placeholder := fmt.Sprintf("varify_token_%d", i)
+		tokens[placeholder] = string(match)
+		i++
+		return []byte(placeholder)
+	})
+	return replaced, tokens
+}
+
+// validateNginxConfHasPort walks the http -> server blocks looking for a
+// `listen` directive that actually uses the {{port}} template token, rather
+// than just grepping for the string anywhere in the file (which would also
+// match it inside a comment).
+func (s *Supplier) validateNginxConfHasPort(tree *parsedNginxConf) error {
+	for _, server := range findServerBlocks(tree) {
+		for _, listen := range server.FindDirectives("listen") {
+			for _, param := range listen.GetParameters() {
+				if tree.resolve(param.GetValue()) == "{{port}}" {
+					return nil
+				}
+			}
+		}
+	}
+
+	s.Log.Error("nginx.conf file must be configured to respect the value of `{{port}}`")
+	return errors.New("no {{port}} in nginx.conf")
+}
+
+// validateNginxConfDirectives rejects nginx.conf files that set up the
+// process in a way the buildpack's own supervision and log draining can't
+// cope with, and warns about dynamic modules that bypass the {{module "..."}}
+// template helper (and so won't get resolved against $NGINX_MODULES).
+func (s *Supplier) validateNginxConfDirectives(tree *parsedNginxConf) error {
+	for _, daemon := range tree.FindDirectives("daemon") {
+		if params := daemon.GetParameters(); len(params) > 0 && tree.resolve(params[0].GetValue()) == "on" {
+			s.Log.Error("nginx.conf must not set `daemon on`; the buildpack runs nginx in the foreground")
+			return errors.New("daemon on is not supported")
+		}
 	}
+
+	for _, name := range []string{"error_log", "access_log", "pid"} {
+		for _, directive := range tree.FindDirectives(name) {
+			params := directive.GetParameters()
+			if len(params) == 0 {
+				continue
+			}
+			path := tree.resolve(params[0].GetValue())
+			if path == "off" {
+				continue
+			}
+			if filepath.IsAbs(path) && !strings.HasPrefix(path, "$") && !strings.HasPrefix(path, "{{") {
+				s.Log.Error("nginx.conf `%s` must be a relative path inside the app directory, not %q", name, path)
+				return fmt.Errorf("absolute %s path %q is not allowed", name, path)
+			}
+		}
+	}
+
+	for _, directive := range tree.FindDirectives("load_module") {
+		params := directive.GetParameters()
+		if len(params) == 0 {
+			continue
+		}
+		value := tree.resolve(params[0].GetValue())
+		if !strings.Contains(value, "{{module") {
+			s.Log.Warning(`Warning: "load_module %s;" does not go through the {{module "..."}} template helper, so it will not be resolved against $NGINX_MODULES.`, value)
+		}
+	}
+
 	return nil
 }
 
+func findServerBlocks(tree *parsedNginxConf) []*nginxconf.Server {
+	var servers []*nginxconf.Server
+	for _, httpDirective := range tree.FindDirectives("http") {
+		http, ok := httpDirective.(*nginxconf.HTTP)
+		if !ok {
+			continue
+		}
+		for _, server := range http.Servers {
+			servers = append(servers, server)
+		}
+	}
+	return servers
+}
+
 func (s *Supplier) validateNginxConfSyntax() error {
 	tmpConfDir, err := ioutil.TempDir("/tmp", "conf")
 	if err != nil {
@@ -260,13 +524,121 @@ func (s *Supplier) InstallNginx() error {
 
 	dir := filepath.Join(s.Stager.DepDir(), "nginx")
 
-	if s.isStableLine(dep.Version) {
+	var stable bool
+	if cacheRoot, ok := s.cacheDir(); ok {
+		installedStable, err := s.installNginxFromCache(cacheRoot, dep, dir)
+		if err != nil {
+			return err
+		}
+		stable = installedStable
+	} else {
+		if err := s.Installer.InstallDependency(dep, dir); err != nil {
+			return err
+		}
+		stable = s.isStableLine(dep.Version)
+	}
+
+	if stable {
 		s.Log.Warning(`Warning: usage of "stable" versions of NGINX is discouraged in most cases by the NGINX team.`)
 	}
 
+	return s.Stager.AddBinDependencyLink(filepath.Join(dir, "nginx", "sbin", "nginx"), "nginx")
+}
+
+// cacheDir reports the cache root to use for staged dependencies, if the
+// Stager backing this supply step opts into caching by implementing
+// CacheStager.
+func (s *Supplier) cacheDir() (string, bool) {
+	cacheStager, ok := s.Stager.(CacheStager)
+	if !ok {
+		return "", false
+	}
+	return cacheStager.CacheDir(), true
+}
+
+func (s *Supplier) nginxCachePaths(cacheRoot, version string) (metadataPath, payloadDir string) {
+	entryDir := filepath.Join(cacheRoot, "nginx", version)
+	return filepath.Join(entryDir, "metadata.toml"), filepath.Join(entryDir, "nginx")
+}
+
+// installNginxFromCache installs nginx via the dependency cache: a hit
+// copies the previously-extracted tree straight into dir, a miss installs
+// normally and then populates the cache for next time. It returns whether
+// the installed version is on the "stable" line, read back from cached
+// metadata on a hit so the warning survives without needing VersionLines.
+//
+// The cache is keyed purely on {version, stack}, not on a content hash:
+// libbuildpack.Dependency only carries a name and a resolved version, so the
+// only checksum available here is one this function computes itself from its
+// own cached copy, which can only ever detect local corruption of the cache
+// (e.g. a half-written payload dir), never a change to the upstream artifact
+// for that version. A resolved {version, stack} pair is what actually
+// identifies "the same nginx" in this buildpack's manifest, so that's what
+// invalidates the cache.
+func (s *Supplier) installNginxFromCache(cacheRoot string, dep libbuildpack.Dependency, dir string) (bool, error) {
+	metadataPath, payloadDir := s.nginxCachePaths(cacheRoot, dep.Version)
+	stack := os.Getenv("CF_STACK")
+
+	if os.Getenv("BP_NGINX_CLEAR_CACHE") == "true" {
+		s.Log.Info("BP_NGINX_CLEAR_CACHE is set, clearing cached nginx %s", dep.Version)
+		if err := os.RemoveAll(filepath.Dir(metadataPath)); err != nil {
+			return false, fmt.Errorf("could not clear nginx cache: %s", err)
+		}
+	}
+
+	if meta, ok := s.loadNginxCacheMetadata(metadataPath); ok && meta.Version == dep.Version && meta.Stack == stack {
+		if exists, err := libbuildpack.FileExists(payloadDir); err == nil && exists {
+			s.Log.Info("Using cached nginx %s", dep.Version)
+			if err := libbuildpack.CopyDirectory(payloadDir, filepath.Join(dir, "nginx")); err != nil {
+				return false, err
+			}
+			return meta.Stable, nil
+		}
+	}
+
 	if err := s.Installer.InstallDependency(dep, dir); err != nil {
-		return err
+		return false, err
 	}
+	stable := s.isStableLine(dep.Version)
 
-	return s.Stager.AddBinDependencyLink(filepath.Join(dir, "nginx", "sbin", "nginx"), "nginx")
+	os.RemoveAll(payloadDir)
+	if err := os.MkdirAll(filepath.Dir(payloadDir), 0755); err != nil {
+		return false, fmt.Errorf("could not create nginx cache dir: %s", err)
+	}
+	if err := libbuildpack.CopyDirectory(filepath.Join(dir, "nginx"), payloadDir); err != nil {
+		return false, fmt.Errorf("could not populate nginx cache: %s", err)
+	}
+
+	if err := s.writeNginxCacheMetadata(metadataPath, nginxCacheMetadata{
+		Version: dep.Version,
+		Stack:   stack,
+		Stable:  stable,
+	}); err != nil {
+		return false, err
+	}
+
+	return stable, nil
+}
+
+func (s *Supplier) loadNginxCacheMetadata(metadataPath string) (nginxCacheMetadata, bool) {
+	var meta nginxCacheMetadata
+	if exists, err := libbuildpack.FileExists(metadataPath); err != nil || !exists {
+		return meta, false
+	}
+	if _, err := toml.DecodeFile(metadataPath, &meta); err != nil {
+		return meta, false
+	}
+	return meta, true
+}
+
+func (s *Supplier) writeNginxCacheMetadata(metadataPath string, meta nginxCacheMetadata) error {
+	if err := os.MkdirAll(filepath.Dir(metadataPath), 0755); err != nil {
+		return err
+	}
+	f, err := os.Create(metadataPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return toml.NewEncoder(f).Encode(meta)
 }
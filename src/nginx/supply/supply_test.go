@@ -0,0 +1,150 @@
+package supply
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/cloudfoundry/libbuildpack"
+)
+
+type fakeStager struct {
+	buildDir string
+}
+
+func (f *fakeStager) AddBinDependencyLink(string, string) error { return nil }
+func (f *fakeStager) DepDir() string                            { return "" }
+func (f *fakeStager) DepsIdx() string                           { return "0" }
+func (f *fakeStager) DepsDir() string                           { return "" }
+func (f *fakeStager) BuildDir() string                          { return f.buildDir }
+func (f *fakeStager) WriteProfileD(string, string) error        { return nil }
+
+func newTestSupplier(t *testing.T, nginxConf string) *Supplier {
+	t.Helper()
+
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dir, "nginx.conf"), []byte(nginxConf), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return &Supplier{
+		Stager: &fakeStager{buildDir: dir},
+		Log:    libbuildpack.NewLogger(ioutil.Discard),
+	}
+}
+
+func TestPlaceholderizeTemplateTokens(t *testing.T) {
+	body := []byte(`listen {{port}};
+load_module {{module "ngx_http_brotli_filter_module"}};
+plain directive;`)
+
+	replaced, tokens := placeholderizeTemplateTokens(body)
+
+	if len(tokens) != 2 {
+		t.Fatalf("got %d tokens, want 2: %v", len(tokens), tokens)
+	}
+	for placeholder, original := range tokens {
+		if string(replaced) == string(body) {
+			t.Fatal("replaced body is identical to the original")
+		}
+		if original != "{{port}}" && original != `{{module "ngx_http_brotli_filter_module"}}` {
+			t.Errorf("unexpected token mapping %s -> %s", placeholder, original)
+		}
+	}
+}
+
+func TestParsedNginxConfResolve(t *testing.T) {
+	p := &parsedNginxConf{tokens: map[string]string{"varify_token_0": "{{port}}"}}
+
+	if got := p.resolve("varify_token_0"); got != "{{port}}" {
+		t.Errorf("resolve(placeholder) = %q, want %q", got, "{{port}}")
+	}
+	if got := p.resolve("8080"); got != "8080" {
+		t.Errorf("resolve(literal) = %q, want it unchanged", got)
+	}
+}
+
+func TestParseNginxConf(t *testing.T) {
+	s := newTestSupplier(t, `
+http {
+  server {
+    listen {{port}};
+  }
+}
+`)
+
+	tree, err := s.parseNginxConf()
+	if err != nil {
+		t.Fatalf("parseNginxConf: %s", err)
+	}
+
+	if err := s.validateNginxConfHasPort(tree); err != nil {
+		t.Errorf("validateNginxConfHasPort: %s", err)
+	}
+}
+
+func TestParseNginxConfMissingPort(t *testing.T) {
+	s := newTestSupplier(t, `
+http {
+  server {
+    listen 8080;
+  }
+}
+`)
+
+	tree, err := s.parseNginxConf()
+	if err != nil {
+		t.Fatalf("parseNginxConf: %s", err)
+	}
+
+	if err := s.validateNginxConfHasPort(tree); err == nil {
+		t.Fatal("expected an error when no listen directive uses {{port}}, got nil")
+	}
+}
+
+func TestParseNginxConfSyntaxError(t *testing.T) {
+	s := newTestSupplier(t, "http { server { listen {{port}}; ")
+
+	if _, err := s.parseNginxConf(); err == nil {
+		t.Fatal("expected a syntax error for an unclosed block, got nil")
+	}
+}
+
+func TestValidateNginxConfDirectivesRejectsDaemonOn(t *testing.T) {
+	s := newTestSupplier(t, "daemon on;\n")
+
+	tree, err := s.parseNginxConf()
+	if err != nil {
+		t.Fatalf("parseNginxConf: %s", err)
+	}
+
+	if err := s.validateNginxConfDirectives(tree); err == nil {
+		t.Fatal("expected an error for `daemon on;`, got nil")
+	}
+}
+
+func TestValidateNginxConfDirectivesRejectsAbsoluteLogPath(t *testing.T) {
+	s := newTestSupplier(t, "error_log /var/log/nginx/error.log;\n")
+
+	tree, err := s.parseNginxConf()
+	if err != nil {
+		t.Fatalf("parseNginxConf: %s", err)
+	}
+
+	if err := s.validateNginxConfDirectives(tree); err == nil {
+		t.Fatal("expected an error for an absolute error_log path, got nil")
+	}
+}
+
+func TestValidateNginxConfDirectivesAllowsTemplatedLogPath(t *testing.T) {
+	s := newTestSupplier(t, `error_log {{env "NGINX_ERROR_LOG"}};`+"\n")
+
+	tree, err := s.parseNginxConf()
+	if err != nil {
+		t.Fatalf("parseNginxConf: %s", err)
+	}
+
+	if err := s.validateNginxConfDirectives(tree); err != nil {
+		t.Errorf("validateNginxConfDirectives: %s", err)
+	}
+}
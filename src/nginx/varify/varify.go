@@ -1,13 +1,15 @@
 package main
 
 import (
-	"html/template"
+	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
-	"fmt"
 	"path/filepath"
-	"encoding/json"
+	"text/template"
+
+	"github.com/PaesslerAG/jsonpath"
 )
 
 func main() {
@@ -25,16 +27,26 @@ func main() {
 	defer fileHandle.Close()
 
 	funcMap := template.FuncMap{
-		"env": os.Getenv,
+		"env": func(name string, defaultValue ...string) string {
+			if v := os.Getenv(name); v != "" {
+				return v
+			}
+			if len(defaultValue) > 0 {
+				return defaultValue[0]
+			}
+			return ""
+		},
 		"port": func() string {
 			return os.Getenv("PORT")
 		},
 		"module": func(name string) string {
 			return fmt.Sprintf("load_module %s.so;", filepath.Join(os.Getenv("NGINX_MODULES"), name))
 		},
-		"svcprop": func(args ...string) string {
-			return getServiceProperty(args)
-		},
+		"svcprop":        getServiceProperty,
+		"svcprop_by_tag": getServicePropertyByTag,
+		"svcprop_json":   getServicePropertyJSONPath,
+		"file":           readFile,
+		"required":       required,
 	}
 
 	t, err := template.New("conf").Funcs(funcMap).Parse(string(body))
@@ -43,32 +55,138 @@ func main() {
 	}
 
 	if err := t.Execute(fileHandle, nil); err != nil {
-		log.Fatalf("Could not write config file: %s", err)
+		log.Fatalf("Could not render config file: %s", err)
+	}
+}
+
+// vcapServices parses VCAP_SERVICES for the template funcs below. It is
+// called, and the variable re-parsed, on every template func call.
+func vcapServices() (map[string][]interface{}, error) {
+	raw := os.Getenv("VCAP_SERVICES")
+	if raw == "" {
+		return map[string][]interface{}{}, nil
+	}
+
+	var services map[string][]interface{}
+	if err := json.Unmarshal([]byte(raw), &services); err != nil {
+		return nil, fmt.Errorf("could not parse VCAP_SERVICES: %s", err)
 	}
+	return services, nil
 }
 
-func getServiceProperty(args []string) string {
-	vcapservices := os.Getenv("VCAP_SERVICES")
-	var services map[string][]interface{} 
-	
-	serviceType := args[0]
-	serviceName := args[1]
-	propKey := args[2]
-
-	json.Unmarshal([]byte(vcapservices), &services)
-
-	for i := 0; i < len(services[serviceType]); i++ {
-		svc := services[serviceType][i].(map[string]interface{})
-		if serviceName == svc["name"].(string) {
-			if len(args) == 3 {
-				prop := svc[propKey].(string)
-				return prop
-			} else if len(args) == 4 {
-				subPropKey:= args[3]
-				prop := svc[propKey].(map[string]interface{})
-				return prop[subPropKey].(string)
+func getServiceProperty(serviceType, serviceName, propKey string) (string, error) {
+	services, err := vcapServices()
+	if err != nil {
+		return "", err
+	}
+
+	for _, raw := range services[serviceType] {
+		svc, ok := raw.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if name, _ := svc["name"].(string); name != serviceName {
+			continue
+		}
+
+		value, ok := svc[propKey].(string)
+		if !ok {
+			return "", fmt.Errorf("service %q of type %q has no string property %q", serviceName, serviceType, propKey)
+		}
+		return value, nil
+	}
+
+	return "", fmt.Errorf("no service named %q of type %q found in VCAP_SERVICES", serviceName, serviceType)
+}
+
+// getServicePropertyByTag finds the first bound service whose `tags` array
+// contains tag, for apps that don't know their broker-assigned service name
+// ahead of time.
+func getServicePropertyByTag(tag, propKey string) (string, error) {
+	services, err := vcapServices()
+	if err != nil {
+		return "", err
+	}
+
+	for _, instances := range services {
+		for _, raw := range instances {
+			svc, ok := raw.(map[string]interface{})
+			if !ok || !serviceHasTag(svc, tag) {
+				continue
 			}
+
+			value, ok := svc[propKey].(string)
+			if !ok {
+				return "", fmt.Errorf("service tagged %q has no string property %q", tag, propKey)
+			}
+			return value, nil
+		}
+	}
+
+	return "", fmt.Errorf("no service tagged %q found in VCAP_SERVICES", tag)
+}
+
+func serviceHasTag(svc map[string]interface{}, tag string) bool {
+	tags, ok := svc["tags"].([]interface{})
+	if !ok {
+		return false
+	}
+	for _, t := range tags {
+		if s, ok := t.(string); ok && s == tag {
+			return true
 		}
 	}
-	return ""
+	return false
+}
+
+// getServicePropertyJSONPath evaluates a JSONPath expression against a bound
+// service, so deeply nested credential blobs from brokered services don't
+// need an N-level hardcoded svcprop variant for every shape of payload.
+func getServicePropertyJSONPath(serviceType, serviceName, path string) (string, error) {
+	services, err := vcapServices()
+	if err != nil {
+		return "", err
+	}
+
+	for _, raw := range services[serviceType] {
+		svc, ok := raw.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if name, _ := svc["name"].(string); name != serviceName {
+			continue
+		}
+
+		value, err := jsonpath.Get(path, svc)
+		if err != nil {
+			return "", fmt.Errorf("could not evaluate %q against service %q: %s", path, serviceName, err)
+		}
+		result, ok := value.(string)
+		if !ok {
+			return "", fmt.Errorf("%q on service %q did not resolve to a string", path, serviceName)
+		}
+		return result, nil
+	}
+
+	return "", fmt.Errorf("no service named %q of type %q found in VCAP_SERVICES", serviceName, serviceType)
+}
+
+// readFile inlines the contents of path, e.g. a cert mounted into the
+// container by a volume service.
+func readFile(path string) (string, error) {
+	body, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("could not read file %q: %s", path, err)
+	}
+	return string(body), nil
+}
+
+// required aborts rendering with a clear error instead of silently emitting
+// an empty string when a mandatory environment variable is missing.
+func required(name string) (string, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return "", fmt.Errorf("required environment variable %q is not set", name)
+	}
+	return v, nil
 }